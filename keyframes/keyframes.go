@@ -0,0 +1,154 @@
+// Package keyframes locates and caches the presentation timestamps of the
+// keyframes (IDR frames) in a video file, so callers can snap an arbitrary
+// seek point to one without a full decode.
+package keyframes
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+// cacheDir holds the on-disk keyframe cache, keyed by path+mtime+size so a
+// modified or replaced file is reprobed rather than served stale data.
+func cacheDir() (string, error) {
+	dir := filepath.Join(os.TempDir(), "dms-keyframes")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func cacheKey(path string, mtime time.Time, size int64) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s:%d:%d", path, mtime.UnixNano(), size)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Keyframes returns the presentation timestamp of every keyframe in the
+// video streams of path (all of them, not only the first), in the order
+// ffprobe reports them, which is ascending for a file with a single video
+// stream. Results are cached to
+// disk keyed by the file's path, modification time and size, so repeated
+// calls for an unchanged file are cheap.
+func Keyframes(path string) ([]time.Duration, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return nil, err
+	}
+	cachePath := filepath.Join(dir, cacheKey(path, fi.ModTime(), fi.Size())+".json")
+
+	if cached, err := readCache(cachePath); err == nil {
+		return cached, nil
+	}
+
+	pts, err := probeKeyframes(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeCache(cachePath, pts); err != nil {
+		log.Printf("caching keyframes for %s: %s", path, err)
+	}
+	return pts, nil
+}
+
+func probeKeyframes(path string) ([]time.Duration, error) {
+	cmd := exec.Command("ffprobe",
+		"-v", "error",
+		"-select_streams", "v",
+		"-skip_frame", "nokey",
+		"-show_frames",
+		"-show_entries", "frame=pts_time",
+		"-of", "csv=p=0",
+		path,
+	)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var pts []time.Duration
+	sc := bufio.NewScanner(out)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		secs, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			continue
+		}
+		pts = append(pts, time.Duration(secs*float64(time.Second)))
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("probing keyframes for %s: %w", path, err)
+	}
+	return pts, nil
+}
+
+func readCache(cachePath string) ([]time.Duration, error) {
+	f, err := os.Open(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var secs []float64
+	if err := json.NewDecoder(f).Decode(&secs); err != nil {
+		return nil, err
+	}
+	pts := make([]time.Duration, len(secs))
+	for i, s := range secs {
+		pts[i] = time.Duration(s * float64(time.Second))
+	}
+	return pts, nil
+}
+
+func writeCache(cachePath string, pts []time.Duration) error {
+	secs := make([]float64, len(pts))
+	for i, d := range pts {
+		secs[i] = d.Seconds()
+	}
+	f, err := os.Create(cachePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(secs)
+}
+
+// NearestAtOrBefore returns the latest keyframe timestamp in pts that is
+// not after target, so a transcode can start its input seek exactly there
+// and guarantee frame-accurate, IDR-aligned output. If pts is empty or
+// target is before the first keyframe, target is returned unchanged.
+func NearestAtOrBefore(pts []time.Duration, target time.Duration) time.Duration {
+	best := target
+	found := false
+	for _, p := range pts {
+		if p > target {
+			break
+		}
+		best = p
+		found = true
+	}
+	if !found {
+		return target
+	}
+	return best
+}
@@ -0,0 +1,31 @@
+package keyframes
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNearestAtOrBefore(t *testing.T) {
+	pts := []time.Duration{0, 2 * time.Second, 5 * time.Second, 10 * time.Second}
+
+	cases := []struct {
+		name   string
+		pts    []time.Duration
+		target time.Duration
+		want   time.Duration
+	}{
+		{"exact match", pts, 5 * time.Second, 5 * time.Second},
+		{"between two keyframes", pts, 7 * time.Second, 5 * time.Second},
+		{"just after the first keyframe", pts, 500 * time.Millisecond, 0},
+		{"before every keyframe returns target unchanged", pts, -time.Second, -time.Second},
+		{"after the last keyframe", pts, time.Minute, 10 * time.Second},
+		{"empty pts returns target unchanged", nil, 3 * time.Second, 3 * time.Second},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := NearestAtOrBefore(c.pts, c.target); got != c.want {
+				t.Fatalf("NearestAtOrBefore() = %s, want %s", got, c.want)
+			}
+		})
+	}
+}
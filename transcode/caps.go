@@ -0,0 +1,147 @@
+package transcode
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	. "github.com/Wkh3/dms/misc"
+)
+
+// RendererCaps describes what a DLNA/HTTP renderer can play without a
+// transcode: the video and audio codecs it decodes, and the resolution and
+// bitrate ceiling it can sustain.
+type RendererCaps struct {
+	VideoCodecs     []string
+	AudioCodecs     []string
+	MaxWidth        int
+	MaxHeight       int
+	MaxVideoBitRate int64 // bits per second, 0 means no limit
+}
+
+// ChromecastCaps is the set of streams a first/second-gen Chromecast will
+// direct-play: H.264 High up to 1080p, with AAC or AC-3 audio.
+var ChromecastCaps = RendererCaps{
+	VideoCodecs:     []string{"h264"},
+	AudioCodecs:     []string{"aac", "ac3"},
+	MaxWidth:        1920,
+	MaxHeight:       1080,
+	MaxVideoBitRate: 20_000_000,
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// CanDirectPlay reports whether info can be served to caps verbatim, with
+// no transcode at all: the first video stream (which must exist) and the
+// first audio stream, if any, must already use a codec the renderer
+// supports, and that video stream must fit within its resolution and
+// bitrate ceiling. Other streams are not examined.
+func CanDirectPlay(info *MediaInfo, caps RendererCaps) bool {
+	video, ok := info.VideoStream()
+	if !ok {
+		return false
+	}
+	if !contains(caps.VideoCodecs, video.CodecName) {
+		return false
+	}
+	if caps.MaxWidth > 0 && video.Width > caps.MaxWidth {
+		return false
+	}
+	if caps.MaxHeight > 0 && video.Height > caps.MaxHeight {
+		return false
+	}
+	if caps.MaxVideoBitRate > 0 && video.BitRate > caps.MaxVideoBitRate {
+		return false
+	}
+	if audio, ok := info.AudioStream(); ok && !contains(caps.AudioCodecs, audio.CodecName) {
+		return false
+	}
+	return true
+}
+
+// TranscodePlan is the minimal set of ffmpeg arguments needed to make info
+// playable by caps: compatible streams are copied, incompatible ones are
+// re-encoded.
+type TranscodePlan struct {
+	VideoArgs []string
+	AudioArgs []string
+	// FilterArgs holds a bare -vf filter expression, e.g. to scale down an
+	// oversized video stream, for the caller to merge into VideoArgs with
+	// appendVideoFilter rather than pass as its own -vf (which would
+	// collide with one videoEncodeArgs already put there for hwaccel
+	// setup). Empty when no filtering is needed.
+	FilterArgs []string
+}
+
+// PlanTranscode returns the TranscodePlan that makes info playable by
+// caps, copying whichever streams are already compatible rather than
+// re-encoding them.
+func PlanTranscode(info *MediaInfo, caps RendererCaps) TranscodePlan {
+	var plan TranscodePlan
+
+	if video, ok := info.VideoStream(); ok {
+		fitsBounds := (caps.MaxWidth == 0 || video.Width <= caps.MaxWidth) &&
+			(caps.MaxHeight == 0 || video.Height <= caps.MaxHeight) &&
+			(caps.MaxVideoBitRate == 0 || video.BitRate <= caps.MaxVideoBitRate)
+		if contains(caps.VideoCodecs, video.CodecName) && fitsBounds {
+			plan.VideoArgs = []string{"-c:v", "copy"}
+		} else {
+			accel := chosenHWAccel()
+			_, codec, _ := videoEncodeArgs(accel, "ultrafast")
+			plan.VideoArgs = codec
+			if caps.MaxHeight > 0 && video.Height > caps.MaxHeight {
+				plan.FilterArgs = []string{"scale=-2:" + strconv.Itoa(caps.MaxHeight)}
+			}
+		}
+	}
+
+	if audio, ok := info.AudioStream(); ok {
+		if contains(caps.AudioCodecs, audio.CodecName) {
+			plan.AudioArgs = []string{"-c:a", "copy"}
+		} else if len(caps.AudioCodecs) > 0 {
+			plan.AudioArgs = []string{"-c:a", caps.AudioCodecs[0]}
+		}
+	}
+
+	return plan
+}
+
+// TranscodeForRenderer streams path in the MP4 container fitted to caps:
+// when CanDirectPlay already holds, every stream is copied as a plain
+// remux; otherwise it re-encodes per PlanTranscode, copying whichever
+// individual streams are already compatible. Unlike TranscodeWithQuality,
+// which picks one rung off a fixed ladder, this fits the output to an
+// arbitrary renderer's exact capabilities (see ChromecastCaps).
+func TranscodeForRenderer(path string, start, length time.Duration, caps RendererCaps, stderr io.Writer) (j *Job, err error) {
+	start = snapToKeyframe(path, start)
+	info, err := Probe(path)
+	if err != nil {
+		return
+	}
+
+	plan := TranscodePlan{VideoArgs: []string{"-c:v", "copy"}, AudioArgs: []string{"-c:a", "copy"}}
+	if !CanDirectPlay(info, caps) {
+		plan = PlanTranscode(info, caps)
+	}
+	videoArgs := plan.VideoArgs
+	if len(plan.FilterArgs) > 0 {
+		videoArgs = appendVideoFilter(videoArgs, plan.FilterArgs[0])
+	}
+
+	args := []string{"ffmpeg", "-ss", FormatDurationSexagesimal(start), "-i", path}
+	args = append(args, videoArgs...)
+	args = append(args, plan.AudioArgs...)
+	args = append(args, "-movflags", "+faststart+frag_keyframe+empty_moov")
+	if length > 0 {
+		args = append(args, "-t", FormatDurationSexagesimal(length))
+	}
+	args = append(args, "-f", "mp4", "pipe:")
+	return transcodePipe(path, args, stderr)
+}
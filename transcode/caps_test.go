@@ -0,0 +1,73 @@
+package transcode
+
+import "testing"
+
+func mediaInfo(codec string, width, height int, bitrate int64, audioCodec string) *MediaInfo {
+	return &MediaInfo{Streams: []StreamInfo{
+		{Index: 0, CodecType: "video", CodecName: codec, Width: width, Height: height, BitRate: bitrate},
+		{Index: 1, CodecType: "audio", CodecName: audioCodec},
+	}}
+}
+
+func TestCanDirectPlay(t *testing.T) {
+	cases := []struct {
+		name string
+		info *MediaInfo
+		caps RendererCaps
+		want bool
+	}{
+		{"within every bound", mediaInfo("h264", 1920, 1080, 10_000_000, "aac"), ChromecastCaps, true},
+		{"codec not supported", mediaInfo("hevc", 1920, 1080, 10_000_000, "aac"), ChromecastCaps, false},
+		{"too wide", mediaInfo("h264", 3840, 2160, 10_000_000, "aac"), ChromecastCaps, false},
+		{"too tall", mediaInfo("h264", 1920, 1200, 10_000_000, "aac"), ChromecastCaps, false},
+		{"bitrate over ceiling", mediaInfo("h264", 1920, 1080, 25_000_000, "aac"), ChromecastCaps, false},
+		{"audio codec not supported", mediaInfo("h264", 1920, 1080, 10_000_000, "opus"), ChromecastCaps, false},
+		{"no video stream", &MediaInfo{}, ChromecastCaps, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := CanDirectPlay(c.info, c.caps); got != c.want {
+				t.Fatalf("CanDirectPlay() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPlanTranscode(t *testing.T) {
+	t.Run("compatible streams are copied", func(t *testing.T) {
+		plan := PlanTranscode(mediaInfo("h264", 1920, 1080, 10_000_000, "aac"), ChromecastCaps)
+		if len(plan.VideoArgs) != 2 || plan.VideoArgs[1] != "copy" {
+			t.Fatalf("VideoArgs = %v, want a copy", plan.VideoArgs)
+		}
+		if len(plan.AudioArgs) != 2 || plan.AudioArgs[1] != "copy" {
+			t.Fatalf("AudioArgs = %v, want a copy", plan.AudioArgs)
+		}
+		if len(plan.FilterArgs) != 0 {
+			t.Fatalf("FilterArgs = %v, want none", plan.FilterArgs)
+		}
+	})
+
+	t.Run("incompatible video codec is re-encoded", func(t *testing.T) {
+		plan := PlanTranscode(mediaInfo("hevc", 1920, 1080, 10_000_000, "aac"), ChromecastCaps)
+		if len(plan.VideoArgs) == 0 || plan.VideoArgs[1] == "copy" {
+			t.Fatalf("VideoArgs = %v, want a re-encode", plan.VideoArgs)
+		}
+	})
+
+	t.Run("oversized video is scaled down and re-encoded", func(t *testing.T) {
+		plan := PlanTranscode(mediaInfo("h264", 3840, 2160, 10_000_000, "aac"), ChromecastCaps)
+		if len(plan.FilterArgs) == 0 {
+			t.Fatal("FilterArgs empty, want a scale filter for an oversized source")
+		}
+		if plan.VideoArgs[1] == "copy" {
+			t.Fatalf("VideoArgs = %v, want a re-encode", plan.VideoArgs)
+		}
+	})
+
+	t.Run("incompatible audio falls back to the renderer's first codec", func(t *testing.T) {
+		plan := PlanTranscode(mediaInfo("h264", 1920, 1080, 10_000_000, "opus"), ChromecastCaps)
+		if len(plan.AudioArgs) != 2 || plan.AudioArgs[1] != ChromecastCaps.AudioCodecs[0] {
+			t.Fatalf("AudioArgs = %v, want %q", plan.AudioArgs, ChromecastCaps.AudioCodecs[0])
+		}
+	})
+}
@@ -0,0 +1,209 @@
+package transcode
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+// HWAccel identifies an ffmpeg hardware acceleration method.
+type HWAccel string
+
+const (
+	// HWAccelNone means software encoding only.
+	HWAccelNone HWAccel = ""
+	// HWAccelVAAPI targets Intel/AMD VAAPI, e.g. a NUC or most Linux boxes
+	// with an iGPU.
+	HWAccelVAAPI HWAccel = "vaapi"
+	// HWAccelNVENC targets NVIDIA GPUs.
+	HWAccelNVENC HWAccel = "nvenc"
+	// HWAccelQSV targets Intel Quick Sync Video.
+	HWAccelQSV HWAccel = "qsv"
+	// HWAccelVideoToolbox targets macOS VideoToolbox.
+	HWAccelVideoToolbox HWAccel = "videotoolbox"
+)
+
+// vaapiRenderNode is the default DRM render node used for VAAPI. Most
+// single-GPU Linux machines expose theirs here.
+const vaapiRenderNode = "/dev/dri/renderD128"
+
+var hwaccelState struct {
+	mu        sync.Mutex
+	probed    bool
+	available map[HWAccel]bool
+	forced    HWAccel
+	disabled  bool
+}
+
+// SetForcedHWAccel forces all subsequent transcodes to use accel,
+// bypassing probing. Pass HWAccelNone to clear.
+func SetForcedHWAccel(accel HWAccel) {
+	hwaccelState.mu.Lock()
+	defer hwaccelState.mu.Unlock()
+	hwaccelState.forced = accel
+}
+
+// DisableHWAccel forces all subsequent transcodes to use software encoding.
+func DisableHWAccel(disabled bool) {
+	hwaccelState.mu.Lock()
+	defer hwaccelState.mu.Unlock()
+	hwaccelState.disabled = disabled
+}
+
+// ProbeHWAccels runs `ffmpeg -hwaccels` and `ffmpeg -encoders` once and
+// caches which of the HWAccel methods this installation can actually use.
+// Subsequent calls return the cached result.
+func ProbeHWAccels() map[HWAccel]bool {
+	hwaccelState.mu.Lock()
+	defer hwaccelState.mu.Unlock()
+	if hwaccelState.probed {
+		return hwaccelState.available
+	}
+	hwaccelState.probed = true
+	hwaccelState.available = probeHWAccelsLocked()
+	return hwaccelState.available
+}
+
+func probeHWAccelsLocked() map[HWAccel]bool {
+	available := make(map[HWAccel]bool)
+
+	var hwaccels bytes.Buffer
+	cmd := exec.Command("ffmpeg", "-hwaccels")
+	cmd.Stdout = &hwaccels
+	if err := cmd.Run(); err != nil {
+		log.Printf("probing ffmpeg hwaccels: %s", err)
+		return available
+	}
+
+	var encoders bytes.Buffer
+	cmd = exec.Command("ffmpeg", "-encoders")
+	cmd.Stdout = &encoders
+	if err := cmd.Run(); err != nil {
+		log.Printf("probing ffmpeg encoders: %s", err)
+		return available
+	}
+	encoderList := encoders.String()
+
+	for _, line := range strings.Split(hwaccels.String(), "\n") {
+		switch strings.TrimSpace(line) {
+		case "vaapi":
+			if strings.Contains(encoderList, "h264_vaapi") {
+				available[HWAccelVAAPI] = true
+			}
+		case "cuda":
+			if strings.Contains(encoderList, "h264_nvenc") {
+				available[HWAccelNVENC] = true
+			}
+		case "qsv":
+			if strings.Contains(encoderList, "h264_qsv") {
+				available[HWAccelQSV] = true
+			}
+		case "videotoolbox":
+			if strings.Contains(encoderList, "h264_videotoolbox") {
+				available[HWAccelVideoToolbox] = true
+			}
+		}
+	}
+	return available
+}
+
+// chosenHWAccel returns the HWAccel to use, honouring a forced choice or a
+// disable, and otherwise preferring the first available accelerator in a
+// fixed order.
+func chosenHWAccel() HWAccel {
+	hwaccelState.mu.Lock()
+	forced, disabled := hwaccelState.forced, hwaccelState.disabled
+	hwaccelState.mu.Unlock()
+
+	if disabled {
+		return HWAccelNone
+	}
+	if forced != HWAccelNone {
+		return forced
+	}
+	available := ProbeHWAccels()
+	for _, accel := range []HWAccel{HWAccelVAAPI, HWAccelNVENC, HWAccelQSV, HWAccelVideoToolbox} {
+		if available[accel] {
+			return accel
+		}
+	}
+	return HWAccelNone
+}
+
+// videoEncodeArgs returns the ffmpeg input-side and codec args for encoding
+// h264 video using accel, along with the software fallback in case accel
+// fails to initialise. Args returned here are inserted before -i for
+// hwaccel setup, and after -i for the codec itself.
+func videoEncodeArgs(accel HWAccel, softwarePreset string) (pre, codec, fallback []string) {
+	fallback = []string{"-c:v", "libx264", "-preset", softwarePreset}
+	switch accel {
+	case HWAccelVAAPI:
+		return []string{"-hwaccel", "vaapi", "-vaapi_device", vaapiRenderNode},
+			[]string{"-vf", "format=nv12,hwupload", "-c:v", "h264_vaapi"},
+			fallback
+	case HWAccelNVENC:
+		return nil,
+			[]string{"-c:v", "h264_nvenc", "-preset", "p4"},
+			fallback
+	case HWAccelQSV:
+		return []string{"-hwaccel", "qsv"},
+			[]string{"-c:v", "h264_qsv"},
+			fallback
+	case HWAccelVideoToolbox:
+		return nil,
+			[]string{"-c:v", "h264_videotoolbox"},
+			fallback
+	default:
+		return nil, fallback, nil
+	}
+}
+
+// appendVideoFilter merges filter into codec's -vf value, so a caller adding
+// its own filtering (subtitle burn-in, scaling) doesn't clobber or duplicate
+// a -vf videoEncodeArgs already put there for hwaccel setup (e.g. VAAPI's
+// "format=nv12,hwupload"). ffmpeg accepts only one -vf per output; two
+// separate -vf flags mean the first is silently overridden by the second.
+// Returns a new slice; codec is left untouched.
+func appendVideoFilter(codec []string, filter string) []string {
+	for i, a := range codec {
+		if a == "-vf" && i+1 < len(codec) {
+			merged := append([]string{}, codec...)
+			merged[i+1] = filter + "," + merged[i+1]
+			return merged
+		}
+	}
+	return append([]string{"-vf", filter}, codec...)
+}
+
+// transcodePipeWithFallback starts a Job for source with args built by
+// substituting codec into buildArgs. If the process dies within a short
+// grace period (the typical signature of a hwaccel that isn't actually
+// usable on this machine), it is restarted with fallback substituted for
+// codec instead. A nil fallback (software encoding was already chosen)
+// disables this retry.
+func transcodePipeWithFallback(source string, buildArgs func(codec []string) []string, codec, fallback []string, stderr io.Writer) (*Job, error) {
+	j, err := newJob(source, buildArgs(codec), stderr)
+	if err != nil {
+		return nil, err
+	}
+	if fallback == nil {
+		return j, nil
+	}
+
+	const grace = 500 * time.Millisecond
+	select {
+	case <-j.done:
+		if j.waitErr == nil {
+			return j, nil
+		}
+		log.Printf("hardware encode for %s failed (%s), falling back to software", source, j.waitErr)
+		return newJob(source, buildArgs(fallback), stderr)
+	case <-time.After(grace):
+		return j, nil
+	}
+}
@@ -0,0 +1,37 @@
+package transcode
+
+import "testing"
+
+func TestAppendVideoFilter(t *testing.T) {
+	t.Run("no existing -vf prepends one", func(t *testing.T) {
+		got := appendVideoFilter([]string{"-c:v", "h264_nvenc"}, "scale=-2:720")
+		want := []string{"-vf", "scale=-2:720", "-c:v", "h264_nvenc"}
+		if !stringSlicesEqual(got, want) {
+			t.Fatalf("appendVideoFilter() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("merges into an existing -vf instead of adding a second one", func(t *testing.T) {
+		codec := []string{"-vf", "format=nv12,hwupload", "-c:v", "h264_vaapi"}
+		got := appendVideoFilter(codec, "scale=-2:720")
+		want := []string{"-vf", "scale=-2:720,format=nv12,hwupload", "-c:v", "h264_vaapi"}
+		if !stringSlicesEqual(got, want) {
+			t.Fatalf("appendVideoFilter() = %v, want %v", got, want)
+		}
+		if codec[1] != "format=nv12,hwupload" {
+			t.Fatalf("appendVideoFilter mutated its input: codec = %v", codec)
+		}
+	})
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,305 @@
+package transcode
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anacrolix/log"
+)
+
+// maxStderrRing is how much of a job's stderr is kept for diagnostics once
+// it exits or is cancelled.
+const maxStderrRing = 8 << 10 // 8KiB
+
+// Progress is the most recently parsed state from ffmpeg's -progress
+// output for a Job.
+type Progress struct {
+	OutTimeUs int64
+	Bitrate   string
+	FPS       float64
+}
+
+// Job wraps a running ffmpeg/avconv invocation. It satisfies io.ReadCloser
+// so it's a drop-in replacement for the bare io.ReadCloser the Transcode*
+// functions used to return, but also exposes Progress, Wait and Cancel so
+// a caller isn't stuck fire-and-forget: Close kills the process instead of
+// leaking it if the reader is abandoned mid-stream.
+type Job struct {
+	id     string
+	source string
+	args   []string
+
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	progress Progress
+	stderr   []byte
+
+	waitOnce sync.Once
+	waitErr  error
+	done     chan struct{}
+}
+
+// ringBuffer implements io.Writer, keeping only the most recent limit
+// bytes written to it.
+type ringBuffer struct {
+	mu    sync.Mutex
+	limit int
+	buf   []byte
+}
+
+func (r *ringBuffer) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf = append(r.buf, p...)
+	if len(r.buf) > r.limit {
+		r.buf = r.buf[len(r.buf)-r.limit:]
+	}
+	return len(p), nil
+}
+
+func (r *ringBuffer) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return string(r.buf)
+}
+
+// newJob starts args (args[0] is the executable) with -progress pipe:2
+// inserted right after the executable so progress can be parsed from stderr alongside ffmpeg's usual
+// diagnostic output, and registers the result with DefaultTracker under
+// source (typically the input file path), subject to its concurrency
+// limit. The process's raw stderr is also copied to callerStderr, if
+// non-nil, same as the stderr io.Writer the old transcodePipe took.
+func newJob(source string, args []string, callerStderr io.Writer) (*Job, error) {
+	if err := DefaultTracker.acquire(source); err != nil {
+		return nil, err
+	}
+
+	withProgress := make([]string, 0, len(args)+2)
+	withProgress = append(withProgress, args[0], "-progress", "pipe:2")
+	withProgress = append(withProgress, args[1:]...)
+	args = withProgress
+	log.Println("transcode command:", args)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		DefaultTracker.release(source)
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		cancel()
+		DefaultTracker.release(source)
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		DefaultTracker.release(source)
+		return nil, err
+	}
+
+	j := &Job{
+		id:     fmt.Sprintf("%s-%d", source, cmd.Process.Pid),
+		source: source,
+		args:   args,
+		cmd:    cmd,
+		stdout: stdout,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	ring := &ringBuffer{limit: maxStderrRing}
+	ringDest := io.Writer(ring)
+	if callerStderr != nil {
+		ringDest = io.MultiWriter(ring, callerStderr)
+	}
+	go j.scanStderr(stderr, ringDest)
+	go j.awaitExit(ring)
+
+	DefaultTracker.register(j)
+	return j, nil
+}
+
+func (j *Job) scanStderr(stderr io.Reader, ringDest io.Writer) {
+	sc := bufio.NewScanner(io.TeeReader(stderr, ringDest))
+	for sc.Scan() {
+		j.parseProgressLine(sc.Text())
+	}
+}
+
+func (j *Job) parseProgressLine(line string) {
+	k, v, ok := strings.Cut(line, "=")
+	if !ok {
+		return
+	}
+	k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	switch k {
+	case "out_time_us":
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			j.progress.OutTimeUs = n
+		}
+	case "bitrate":
+		j.progress.Bitrate = v
+	case "fps":
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			j.progress.FPS = f
+		}
+	}
+}
+
+func (j *Job) awaitExit(ring *ringBuffer) {
+	err := j.cmd.Wait()
+	j.mu.Lock()
+	j.stderr = []byte(ring.String())
+	j.mu.Unlock()
+	// A non-nil ProcessState that did Exited() means ffmpeg itself failed;
+	// anything else (signalled, nil state) means we killed it via
+	// Cancel/Close, which isn't a failure worth logging.
+	if err != nil && j.cmd.ProcessState != nil && j.cmd.ProcessState.Exited() {
+		log.Printf("command %v failed: %s", j.args, err)
+	}
+	j.waitErr = err
+	// Release this job's concurrency slot before signalling done: a caller
+	// unblocked by done (e.g. transcodePipeWithFallback starting a software
+	// fallback after a failed hwaccel job) must see the slot already freed,
+	// not still held pending this goroutine's next line.
+	DefaultTracker.unregister(j)
+	close(j.done)
+}
+
+// Read satisfies io.Reader by reading the underlying process's stdout.
+func (j *Job) Read(p []byte) (int, error) {
+	return j.stdout.Read(p)
+}
+
+// Close kills the process if it's still running and releases its
+// concurrency slot. It's safe to call multiple times.
+func (j *Job) Close() error {
+	j.cancel()
+	j.stdout.Close()
+	<-j.done
+	return nil
+}
+
+// Cancel terminates the job's process. Equivalent to Close, kept as a
+// named, intention-revealing alias for use from an admin endpoint.
+func (j *Job) Cancel() {
+	j.Close()
+}
+
+// Wait blocks until the job's process exits, returning its error, if any.
+// Unlike Close it does not kill the process.
+func (j *Job) Wait() error {
+	<-j.done
+	return j.waitErr
+}
+
+// Progress returns the most recently parsed -progress state.
+func (j *Job) Progress() Progress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.progress
+}
+
+// Stderr returns the tail of the job's stderr output, for diagnosing a
+// failed job.
+func (j *Job) Stderr() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return string(j.stderr)
+}
+
+// ID uniquely identifies this job for Tracker.Cancel.
+func (j *Job) ID() string { return j.id }
+
+// Tracker records every in-flight Job so an admin endpoint can list or
+// cancel them, and enforces a per-source concurrency limit so a client
+// rapidly retrying a request doesn't spawn five ffmpegs against the same
+// file.
+type Tracker struct {
+	mu             sync.Mutex
+	jobs           map[string]*Job
+	bySource       map[string]int
+	perSourceLimit int
+}
+
+// DefaultTracker is the package-wide Job registry used by every Transcode*
+// entry point.
+var DefaultTracker = NewTracker(2)
+
+// NewTracker returns a Tracker allowing at most perSourceLimit concurrent
+// jobs per source. A limit of 0 means unlimited.
+func NewTracker(perSourceLimit int) *Tracker {
+	return &Tracker{
+		jobs:           make(map[string]*Job),
+		bySource:       make(map[string]int),
+		perSourceLimit: perSourceLimit,
+	}
+}
+
+func (t *Tracker) acquire(source string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.perSourceLimit > 0 && t.bySource[source] >= t.perSourceLimit {
+		return fmt.Errorf("transcode: too many concurrent jobs for %s", source)
+	}
+	t.bySource[source]++
+	return nil
+}
+
+func (t *Tracker) release(source string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bySource[source]--
+	if t.bySource[source] <= 0 {
+		delete(t.bySource, source)
+	}
+}
+
+func (t *Tracker) register(j *Job) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.jobs[j.id] = j
+}
+
+func (t *Tracker) unregister(j *Job) {
+	t.mu.Lock()
+	delete(t.jobs, j.id)
+	t.mu.Unlock()
+	t.release(j.source)
+}
+
+// List returns every job currently tracked, i.e. still running.
+func (t *Tracker) List() []*Job {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	jobs := make([]*Job, 0, len(t.jobs))
+	for _, j := range t.jobs {
+		jobs = append(jobs, j)
+	}
+	return jobs
+}
+
+// Cancel stops the job with the given ID, if it's still running.
+func (t *Tracker) Cancel(id string) error {
+	t.mu.Lock()
+	j, ok := t.jobs[id]
+	t.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("transcode: no such job %q", id)
+	}
+	return j.Close()
+}
@@ -0,0 +1,71 @@
+package transcode
+
+import "testing"
+
+func TestTrackerAcquireRelease(t *testing.T) {
+	tr := NewTracker(2)
+
+	if err := tr.acquire("movie.mkv"); err != nil {
+		t.Fatalf("acquire 1: %v", err)
+	}
+	if err := tr.acquire("movie.mkv"); err != nil {
+		t.Fatalf("acquire 2: %v", err)
+	}
+	if err := tr.acquire("movie.mkv"); err == nil {
+		t.Fatal("acquire 3: expected an error past the per-source limit")
+	}
+
+	tr.release("movie.mkv")
+	if err := tr.acquire("movie.mkv"); err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+
+	if _, ok := tr.bySource["movie.mkv"]; !ok {
+		t.Fatal("bySource count for movie.mkv should still be tracked")
+	}
+	tr.release("movie.mkv")
+	tr.release("movie.mkv")
+	if _, ok := tr.bySource["movie.mkv"]; ok {
+		t.Fatal("bySource entry should be removed once the count drops to zero")
+	}
+}
+
+func TestTrackerAcquireReleaseIndependentSources(t *testing.T) {
+	tr := NewTracker(1)
+
+	if err := tr.acquire("a.mkv"); err != nil {
+		t.Fatalf("acquire a.mkv: %v", err)
+	}
+	if err := tr.acquire("b.mkv"); err != nil {
+		t.Fatalf("acquire b.mkv should not be limited by a.mkv's count: %v", err)
+	}
+}
+
+func TestTrackerUnlimited(t *testing.T) {
+	tr := NewTracker(0)
+	for i := 0; i < 5; i++ {
+		if err := tr.acquire("movie.mkv"); err != nil {
+			t.Fatalf("acquire %d with no limit: %v", i, err)
+		}
+	}
+}
+
+// TestAwaitExitReleasesBeforeDone guards against a caller unblocked by
+// Job.done (e.g. transcodePipeWithFallback starting a software fallback)
+// observing the just-finished job's concurrency slot as still held: the
+// slot must be released before done closes, not after.
+func TestAwaitExitReleasesBeforeDone(t *testing.T) {
+	source := "movie.mkv"
+	j, err := newJob(source, []string{"true"}, nil)
+	if err != nil {
+		t.Fatalf("newJob: %v", err)
+	}
+	j.Wait()
+
+	DefaultTracker.mu.Lock()
+	_, held := DefaultTracker.bySource[source]
+	DefaultTracker.mu.Unlock()
+	if held {
+		t.Fatalf("bySource[%q] still held after Wait returned", source)
+	}
+}
@@ -0,0 +1,152 @@
+package transcode
+
+import (
+	"bytes"
+	"encoding/json"
+	"os/exec"
+)
+
+// MediaInfo is a typed view of an ffprobe run against one source file,
+// replacing the untyped map[string]interface{} previously returned by
+// github.com/anacrolix/ffprobe and cast at each use site.
+type MediaInfo struct {
+	Format  Format
+	Streams []StreamInfo
+}
+
+// Format mirrors the subset of ffprobe's top-level "format" object that
+// callers here care about.
+type Format struct {
+	FormatName string
+	Duration   float64
+	BitRate    int64
+}
+
+// StreamInfo is one entry of ffprobe's "streams" array, typed and with the
+// string-encoded numeric fields ffprobe emits (bit_rate, sample_rate, ...)
+// already converted.
+type StreamInfo struct {
+	Index         int
+	CodecType     string
+	CodecName     string
+	Profile       string
+	PixFmt        string
+	Width         int
+	Height        int
+	BitRate       int64
+	Channels      int
+	ChannelLayout string
+	SampleRate    int
+	Tags          map[string]string
+	Disposition   map[string]int
+}
+
+// rawProbe and rawStream mirror ffprobe's JSON output exactly, with the
+// numeric fields ffprobe sometimes quotes as strings (bit_rate, sample_rate,
+// duration) declared as json.Number so either encoding unmarshals cleanly.
+type rawProbe struct {
+	Format  rawFormat   `json:"format"`
+	Streams []rawStream `json:"streams"`
+}
+
+type rawFormat struct {
+	FormatName string      `json:"format_name"`
+	Duration   json.Number `json:"duration"`
+	BitRate    json.Number `json:"bit_rate"`
+}
+
+type rawStream struct {
+	Index         int               `json:"index"`
+	CodecType     string            `json:"codec_type"`
+	CodecName     string            `json:"codec_name"`
+	Profile       string            `json:"profile"`
+	PixFmt        string            `json:"pix_fmt"`
+	Width         int               `json:"width"`
+	Height        int               `json:"height"`
+	BitRate       json.Number       `json:"bit_rate"`
+	Channels      int               `json:"channels"`
+	ChannelLayout string            `json:"channel_layout"`
+	SampleRate    json.Number       `json:"sample_rate"`
+	Tags          map[string]string `json:"tags"`
+	Disposition   map[string]int    `json:"disposition"`
+}
+
+// Probe runs ffprobe against path and returns a typed MediaInfo. It
+// replaces the anacrolix/ffprobe-based map[string]interface{} previously
+// used by streamArgs and its callers.
+func Probe(path string) (*MediaInfo, error) {
+	cmd := exec.Command("ffprobe",
+		"-v", "error",
+		"-show_format",
+		"-show_streams",
+		"-of", "json",
+		path,
+	)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+
+	var raw rawProbe
+	if err := json.Unmarshal(out.Bytes(), &raw); err != nil {
+		return nil, err
+	}
+	return toMediaInfo(raw), nil
+}
+
+func toMediaInfo(raw rawProbe) *MediaInfo {
+	info := &MediaInfo{
+		Format: Format{
+			FormatName: raw.Format.FormatName,
+			Duration:   numberOrZero(raw.Format.Duration),
+			BitRate:    int64(numberOrZero(raw.Format.BitRate)),
+		},
+	}
+	for _, rs := range raw.Streams {
+		info.Streams = append(info.Streams, StreamInfo{
+			Index:         rs.Index,
+			CodecType:     rs.CodecType,
+			CodecName:     rs.CodecName,
+			Profile:       rs.Profile,
+			PixFmt:        rs.PixFmt,
+			Width:         rs.Width,
+			Height:        rs.Height,
+			BitRate:       int64(numberOrZero(rs.BitRate)),
+			Channels:      rs.Channels,
+			ChannelLayout: rs.ChannelLayout,
+			SampleRate:    int(numberOrZero(rs.SampleRate)),
+			Tags:          rs.Tags,
+			Disposition:   rs.Disposition,
+		})
+	}
+	return info
+}
+
+func numberOrZero(n json.Number) float64 {
+	f, err := n.Float64()
+	if err != nil {
+		return 0
+	}
+	return f
+}
+
+// VideoStream returns the first video stream in info, if any.
+func (info *MediaInfo) VideoStream() (StreamInfo, bool) {
+	for _, s := range info.Streams {
+		if s.CodecType == "video" {
+			return s, true
+		}
+	}
+	return StreamInfo{}, false
+}
+
+// AudioStream returns the first audio stream in info, if any.
+func (info *MediaInfo) AudioStream() (StreamInfo, bool) {
+	for _, s := range info.Streams {
+		if s.CodecType == "audio" {
+			return s, true
+		}
+	}
+	return StreamInfo{}, false
+}
@@ -0,0 +1,112 @@
+package transcode
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	. "github.com/Wkh3/dms/misc"
+)
+
+// Quality describes one rung of the transcode bitrate ladder: a target
+// resolution, bitrate and codec for an HTTP client or renderer to request.
+type Quality struct {
+	Name             string
+	Height           int
+	VideoBitrateKbps int
+	VideoCodec       string
+	AudioCodec       string
+	AudioBitrateKbps int
+}
+
+// MaxQuality is the passthrough rung: when selected TranscodeWithQuality
+// copies the source streams instead of re-encoding them. For any other
+// rung it still copies the video (but re-encodes the audio) when
+// canCopyVideo holds.
+var MaxQuality = Quality{Name: "Max"}
+
+// QualityLadder is the set of profiles a caller may request from
+// TranscodeWithQuality, in ascending order.
+var QualityLadder = []Quality{
+	{Name: "360p", Height: 360, VideoBitrateKbps: 700, VideoCodec: "h264", AudioCodec: "aac", AudioBitrateKbps: 96},
+	{Name: "480p", Height: 480, VideoBitrateKbps: 1500, VideoCodec: "h264", AudioCodec: "aac", AudioBitrateKbps: 128},
+	{Name: "720p", Height: 720, VideoBitrateKbps: 3000, VideoCodec: "h264", AudioCodec: "aac", AudioBitrateKbps: 128},
+	{Name: "1080p", Height: 1080, VideoBitrateKbps: 6000, VideoCodec: "h264", AudioCodec: "aac", AudioBitrateKbps: 192},
+	{Name: "4K", Height: 2160, VideoBitrateKbps: 16000, VideoCodec: "h264", AudioCodec: "aac", AudioBitrateKbps: 192},
+	MaxQuality,
+}
+
+// copyBitrateTolerance is how far over a rung's target bitrate a source may
+// be and still be copied rather than re-encoded. Re-encoding exists to cap
+// bitrate as well as resolution, so a source merely a little over the rung
+// isn't worth a transcode for, but one well over it (e.g. a 40Mbps 1080p
+// source against the 6Mbps 1080p rung) must still be brought down.
+const copyBitrateTolerance = 1.1
+
+// canCopyVideo reports whether the source video can be served as-is for
+// quality: either quality is MaxQuality, or the source already uses the
+// requested codec, is no taller than what quality asks for, and is no more
+// than copyBitrateTolerance over its target bitrate.
+func canCopyVideo(quality Quality, sourceHeight int, sourceCodec string, sourceBitrateKbps int) bool {
+	if quality.Name == MaxQuality.Name {
+		return true
+	}
+	if sourceCodec != quality.VideoCodec || sourceHeight > quality.Height {
+		return false
+	}
+	return float64(sourceBitrateKbps) <= float64(quality.VideoBitrateKbps)*copyBitrateTolerance
+}
+
+// TranscodeWithQuality streams path in the MP4 container at quality,
+// negotiating down to a stream copy where the source already satisfies the
+// request so no re-encode is needed. It otherwise follows the same
+// hardware-accelerated encode path as WebTranscode.
+func TranscodeWithQuality(path string, quality Quality, start, length time.Duration, stderr io.Writer) (j *Job, err error) {
+	start = snapToKeyframe(path, start)
+	info, err := Probe(path)
+	if err != nil {
+		return
+	}
+	video, _ := info.VideoStream()
+	copying := canCopyVideo(quality, video.Height, video.CodecName, int(video.BitRate/1000))
+
+	var pre, videoArgs, fallback []string
+	if copying {
+		videoArgs = []string{"-c:v", "copy"}
+	} else {
+		pre, videoArgs, fallback = videoEncodeArgs(chosenHWAccel(), "ultrafast")
+		videoArgs = append(videoArgs, "-b:v", strconv.Itoa(quality.VideoBitrateKbps)+"k")
+		if quality.Height > 0 {
+			videoArgs = appendVideoFilter(videoArgs, "scale=-2:"+strconv.Itoa(quality.Height))
+		}
+		if fallback != nil {
+			fallback = append(append([]string{}, fallback...), "-b:v", strconv.Itoa(quality.VideoBitrateKbps)+"k")
+			if quality.Height > 0 {
+				fallback = appendVideoFilter(fallback, "scale=-2:"+strconv.Itoa(quality.Height))
+			}
+		}
+	}
+
+	audioArgs := []string{"-c:a", "copy"}
+	if quality.Name != MaxQuality.Name {
+		audioArgs = []string{"-c:a", quality.AudioCodec, "-ab", strconv.Itoa(quality.AudioBitrateKbps) + "k"}
+	}
+
+	buildArgs := func(video []string) []string {
+		args := []string{"ffmpeg"}
+		args = append(args, pre...)
+		args = append(args, "-ss", FormatDurationSexagesimal(start), "-i", path)
+		args = append(args, video...)
+		args = append(args, audioArgs...)
+		args = append(args, "-movflags", "+faststart+frag_keyframe+empty_moov")
+		if length > 0 {
+			args = append(args, "-t", FormatDurationSexagesimal(length))
+		}
+		return append(args, "-f", "mp4", "pipe:")
+	}
+
+	if copying {
+		return transcodePipe(path, buildArgs(videoArgs), stderr)
+	}
+	return transcodePipeWithFallback(path, buildArgs, videoArgs, fallback, stderr)
+}
@@ -0,0 +1,34 @@
+package transcode
+
+import "testing"
+
+func TestCanCopyVideo(t *testing.T) {
+	q1080p := QualityLadder[3] // 1080p, 6000kbps, h264
+	if q1080p.Name != "1080p" {
+		t.Fatalf("QualityLadder[3] = %q, want 1080p", q1080p.Name)
+	}
+
+	cases := []struct {
+		name             string
+		quality          Quality
+		height           int
+		codec            string
+		bitrateKbps      int
+		wantCanCopyVideo bool
+	}{
+		{"max quality always copies", MaxQuality, 2160, "hevc", 80_000, true},
+		{"matching codec, height and bitrate", q1080p, 1080, "h264", 5800, true},
+		{"bitrate within tolerance", q1080p, 1080, "h264", 6600, true},
+		{"bitrate far over tolerance re-encodes", q1080p, 1080, "h264", 40_000, false},
+		{"codec mismatch re-encodes", q1080p, 1080, "hevc", 5000, false},
+		{"taller than rung re-encodes", q1080p, 2160, "h264", 5000, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := canCopyVideo(c.quality, c.height, c.codec, c.bitrateKbps)
+			if got != c.wantCanCopyVideo {
+				t.Fatalf("canCopyVideo() = %v, want %v", got, c.wantCanCopyVideo)
+			}
+		})
+	}
+}
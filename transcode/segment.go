@@ -0,0 +1,511 @@
+package transcode
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"github.com/Wkh3/dms/keyframes"
+	. "github.com/Wkh3/dms/misc"
+)
+
+// SegmentFormat identifies the container/manifest flavour produced by a
+// segmented Stream.
+type SegmentFormat int
+
+const (
+	// FormatHLSFMP4 produces an HLS playlist backed by fragmented MP4
+	// segments, suitable for fMP4-capable players.
+	FormatHLSFMP4 SegmentFormat = iota
+	// FormatHLSTS produces an HLS playlist backed by MPEG-TS segments.
+	FormatHLSTS
+	// FormatDASH produces an MPEG-DASH manifest.
+	FormatDASH
+)
+
+const (
+	defaultSegmentDuration = 6 * time.Second
+	// defaultBufferMax is the number of chunks behind goal that are kept
+	// around before being pruned.
+	defaultBufferMax = 5
+	// defaultSeekAheadLimit is how many segments past the encoder's current
+	// position a request may land on before the encoder is restarted at the
+	// new offset, rather than being left to catch up on its own.
+	defaultSeekAheadLimit = 3
+	defaultIdleTimeout    = 30 * time.Second
+)
+
+// errSegmentSuperseded is wait's error when a restart abandons a chunk
+// before the encoder ever produces it, so a caller blocked on it fails fast
+// instead of waiting out its own context's deadline.
+var errSegmentSuperseded = errors.New("transcode: segment superseded by a restart")
+
+// Chunk is a single generated segment. Path is only valid once ready is
+// closed and err is nil.
+type Chunk struct {
+	Index int
+	Path  string
+	ready chan struct{}
+	err   error
+	done  bool
+}
+
+func newChunk(index int) *Chunk {
+	return &Chunk{Index: index, ready: make(chan struct{})}
+}
+
+// fulfil and abandon are both only ever called with s.mu held, so the done
+// guard doesn't need its own lock; it exists because a chunk abandoned by
+// one restart can still be sitting in s.chunks, under the same index, when
+// a later restart's encoder run reaches that index and tries to fulfil it.
+func (c *Chunk) fulfil(path string) {
+	if c.done {
+		return
+	}
+	c.done = true
+	c.Path = path
+	close(c.ready)
+}
+
+// abandon fails the chunk with err instead of producing it, for a chunk a
+// restart will never generate.
+func (c *Chunk) abandon(err error) {
+	if c.done {
+		return
+	}
+	c.done = true
+	c.err = err
+	close(c.ready)
+}
+
+// wait blocks until the chunk is generated, abandoned, or ctx is done.
+func (c *Chunk) wait(ctx context.Context) error {
+	select {
+	case <-c.ready:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// segmentOpenLine matches the "Opening '<file>' for writing" lines ffmpeg
+// emits at -loglevel verbose or above as it writes each output file.
+var segmentOpenLine = regexp.MustCompile(`Opening '([^']*)' for writing`)
+
+// segmentIndexPattern extracts the index from a segment's basename. All
+// three SegmentFormats are configured (in segmentArgs) to name their media
+// segments "segmentNNNNN.{m4s,ts}", so the same pattern covers HLS-TS,
+// HLS-fMP4 and DASH; it deliberately doesn't match DASH's "init.m4s", which
+// isn't a Chunk.
+var segmentIndexPattern = regexp.MustCompile(`segment(\d+)\.(?:m4s|ts)$`)
+
+// parseSegmentOpen extracts the path and segment index from an ffmpeg
+// stderr line logged when it opens a segment file for writing, or reports
+// ok = false for any other line (including the manifest and DASH's init
+// segment).
+func parseSegmentOpen(line string) (path string, index int, ok bool) {
+	m := segmentOpenLine.FindStringSubmatch(line)
+	if m == nil {
+		return "", 0, false
+	}
+	im := segmentIndexPattern.FindStringSubmatch(filepath.Base(m[1]))
+	if im == nil {
+		return "", 0, false
+	}
+	index, err := strconv.Atoi(im[1])
+	if err != nil {
+		return "", 0, false
+	}
+	return m[1], index, true
+}
+
+// Stream manages a single long-running ffmpeg process that produces
+// segments for one source file at one quality profile, on demand. Clients
+// ask for a segment index; Stream seeks the encoder there if necessary and
+// blocks the caller until the segment exists.
+type Stream struct {
+	path            string
+	format          SegmentFormat
+	height          int
+	bitrate         int
+	codec           string
+	segmentDuration time.Duration
+	dir             string
+
+	mu         sync.Mutex
+	cmd        *exec.Cmd
+	cancel     context.CancelFunc
+	goal       int
+	current    int
+	chunks     map[int]*Chunk
+	idleTimer  *time.Timer
+	dashSegDir string
+}
+
+// NewStream prepares a Stream for path at the given quality profile. The
+// encoder is not started until the first chunk is requested.
+func NewStream(path string, format SegmentFormat, height, bitrate int, codec string) (*Stream, error) {
+	dir, err := os.MkdirTemp("", "dms-segment-*")
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{
+		path:            path,
+		format:          format,
+		height:          height,
+		bitrate:         bitrate,
+		codec:           codec,
+		segmentDuration: defaultSegmentDuration,
+		dir:             dir,
+		chunks:          make(map[int]*Chunk),
+	}, nil
+}
+
+// Close terminates the encoder, if any, and removes the temp directory.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	s.stopLocked()
+	s.mu.Unlock()
+	return os.RemoveAll(s.dir)
+}
+
+// stopLocked kills the running encoder, if any, and clears s.cmd so chunk
+// sees a stopped Stream as needing a fresh restart rather than mistaking
+// the now-dead process for one that's still producing segments. Caller
+// must hold s.mu.
+func (s *Stream) stopLocked() {
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	s.cmd = nil
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+}
+
+// chunk returns the Chunk for index, starting or restarting the encoder as
+// required. It does not block for the chunk to be ready; call wait on the
+// result.
+func (s *Stream) chunk(index int) *Chunk {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index > s.goal {
+		s.goal = index
+	}
+	s.resetIdleTimerLocked()
+	if c, ok := s.chunks[index]; ok {
+		return c
+	}
+	c := newChunk(index)
+	s.chunks[index] = c
+
+	if s.cmd == nil || index < s.current || index-s.current > defaultSeekAheadLimit {
+		s.restartLocked(index)
+	}
+	return c
+}
+
+// abandonBeforeLocked fails any chunk not yet produced for an index before
+// fromIndex: the encoder a restart starts only ever seeks forward from
+// fromIndex, so those chunks will never be generated, and a caller
+// blocked in wait on one would otherwise hang until its own context's
+// deadline rather than failing fast. Caller must hold s.mu.
+func (s *Stream) abandonBeforeLocked(fromIndex int) {
+	for i, c := range s.chunks {
+		if i < fromIndex {
+			c.abandon(errSegmentSuperseded)
+		}
+	}
+}
+
+// restartLocked kills any running encoder and starts a new one seeking to
+// fromIndex*segmentDuration. Caller must hold s.mu.
+func (s *Stream) restartLocked(fromIndex int) {
+	s.stopLocked()
+	s.abandonBeforeLocked(fromIndex)
+	s.current = fromIndex
+
+	// Align the seek to a keyframe so the segment starts with an IDR,
+	// which both avoids a leading black frame and lets a same-codec source
+	// be copied into the segment rather than re-encoded.
+	offset := time.Duration(fromIndex) * s.segmentDuration
+	if pts, err := keyframes.Keyframes(s.path); err == nil {
+		offset = keyframes.NearestAtOrBefore(pts, offset)
+	} else {
+		log.Printf("keyframes for %s: %s", s.path, err)
+	}
+	args := []string{
+		"ffmpeg",
+		"-loglevel", "verbose",
+		"-ss", FormatDurationSexagesimal(offset),
+		"-i", s.path,
+		"-c:v", s.codec, "-b:v", strconv.Itoa(s.bitrate),
+		"-c:a", "aac",
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", int(s.segmentDuration.Seconds())),
+	}
+	segArgs, err := s.segmentArgs(fromIndex)
+	if err != nil {
+		log.Printf("segment stream %s: %s", s.path, err)
+		return
+	}
+	args = append(args, segArgs...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		log.Printf("segment stream %s: %s", s.path, err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("segment stream %s: %s", s.path, err)
+		return
+	}
+	s.cmd = cmd
+	go s.scan(bufio.NewScanner(stderr), fromIndex)
+	go func() {
+		if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+			log.Printf("segment encoder for %s exited: %s", s.path, err)
+		}
+	}()
+	s.resetIdleTimerLocked()
+}
+
+// dashSegmentDir returns the subdirectory (relative to s.dir) that a DASH
+// restart starting at fromIndex writes its segments into.
+func dashSegmentDir(fromIndex int) string {
+	return fmt.Sprintf("restart-%05d", fromIndex)
+}
+
+// segmentArgs returns the muxer arguments for s.format, naming segments
+// "segmentNNNNN.{m4s,ts}" (matched by segmentIndexPattern).
+//
+// For the hls muxer, -hls_start_number pins the first segment written to
+// fromIndex, so the number ffmpeg puts in each segment's filename is
+// always that segment's true Chunk index, restart or not: without that
+// pin, a restart renumbers from 0 regardless of where the encoder actually
+// seeked to, and a segment a client is still reading gets silently
+// overwritten.
+//
+// The dash muxer has no equivalent start-number option, so it always
+// numbers a fresh run's segments from 1; to stop a restart's
+// segment00001.m4s from overwriting a previous run's file of the same
+// name, each restart gets its own subdirectory instead, and
+// segmentAbsoluteIndex maps ffmpeg's local numbering back to the true
+// Chunk index using fromIndex.
+func (s *Stream) segmentArgs(fromIndex int) ([]string, error) {
+	startNumber := strconv.Itoa(fromIndex)
+	switch s.format {
+	case FormatHLSFMP4:
+		return []string{
+			"-f", "hls",
+			"-hls_time", strconv.Itoa(int(s.segmentDuration.Seconds())),
+			"-hls_segment_type", "fmp4",
+			"-hls_flags", "independent_segments",
+			"-hls_segment_filename", filepath.Join(s.dir, "segment%05d.m4s"),
+			"-hls_start_number", startNumber,
+			filepath.Join(s.dir, "stream.m3u8"),
+		}, nil
+	case FormatHLSTS:
+		return []string{
+			"-f", "hls",
+			"-hls_time", strconv.Itoa(int(s.segmentDuration.Seconds())),
+			"-hls_segment_filename", filepath.Join(s.dir, "segment%05d.ts"),
+			"-hls_start_number", startNumber,
+			filepath.Join(s.dir, "stream.m3u8"),
+		}, nil
+	case FormatDASH:
+		segDir := dashSegmentDir(fromIndex)
+		if err := os.MkdirAll(filepath.Join(s.dir, segDir), 0755); err != nil {
+			return nil, err
+		}
+		// ffmpeg overwrites stream.mpd on every restart to reference only
+		// this new segDir, so the previous restart's directory (and
+		// whatever segments are still in it) can never be reached by a
+		// manifest fetched from now on; remove it rather than leaking a
+		// directory per restart for the life of the Stream.
+		if s.dashSegDir != "" && s.dashSegDir != segDir {
+			os.RemoveAll(filepath.Join(s.dir, s.dashSegDir))
+		}
+		s.dashSegDir = segDir
+		return []string{
+			"-f", "dash",
+			"-seg_duration", strconv.Itoa(int(s.segmentDuration.Seconds())),
+			"-use_template", "1",
+			"-use_timeline", "0",
+			"-init_seg_name", segDir + "/init.m4s",
+			"-media_seg_name", segDir + "/segment$Number%05d$.m4s",
+			filepath.Join(s.dir, "stream.mpd"),
+		}, nil
+	}
+	return nil, fmt.Errorf("transcode: unknown segment format %v", s.format)
+}
+
+// segmentAbsoluteIndex translates the segment number ffmpeg put in a
+// filename into the true Chunk index. hls's numbers are already absolute
+// (segmentArgs pins -hls_start_number to fromIndex); dash's are always
+// local to the current restart, counting up from 1, so they need
+// fromIndex added back in.
+func segmentAbsoluteIndex(format SegmentFormat, fromIndex, localIndex int) int {
+	if format != FormatDASH {
+		return localIndex
+	}
+	return fromIndex - 1 + localIndex
+}
+
+// scan watches ffmpeg's stderr for the segment files it opens and fulfils
+// the matching chunk. fromIndex is the index this restart began at, needed
+// to translate dash's per-restart-local numbering (see
+// segmentAbsoluteIndex); hls's numbering is already absolute and ignores
+// it.
+func (s *Stream) scan(sc *bufio.Scanner, fromIndex int) {
+	for sc.Scan() {
+		path, localIndex, ok := parseSegmentOpen(sc.Text())
+		if !ok {
+			continue
+		}
+		index := segmentAbsoluteIndex(s.format, fromIndex, localIndex)
+		s.mu.Lock()
+		c, ok := s.chunks[index]
+		if !ok {
+			c = newChunk(index)
+			s.chunks[index] = c
+		}
+		c.fulfil(path)
+		if index > s.current {
+			s.current = index
+		}
+		s.pruneLocked()
+		s.mu.Unlock()
+	}
+}
+
+// pruneLocked discards chunks more than bufferMax behind goal. Caller must
+// hold s.mu.
+func (s *Stream) pruneLocked() {
+	for i, c := range s.chunks {
+		if i < s.goal-defaultBufferMax {
+			if c.Path != "" {
+				os.Remove(c.Path)
+			}
+			delete(s.chunks, i)
+		}
+	}
+}
+
+// resetIdleTimerLocked arms the timer that kills the encoder after a period
+// with no new segments requested. Caller must hold s.mu.
+func (s *Stream) resetIdleTimerLocked() {
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	s.idleTimer = time.AfterFunc(defaultIdleTimeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.stopLocked()
+	})
+}
+
+// SegmentedStream serves HLS/DASH manifests and segments for a collection
+// of sources, generating segments on demand rather than transcoding the
+// whole file up front. This lets seekable playback start immediately and
+// keeps at most one ffmpeg alive per registered key (one source at one
+// quality profile).
+type SegmentedStream struct {
+	mu      sync.Mutex
+	streams map[string]*Stream
+}
+
+// NewSegmentedStream returns an empty SegmentedStream ready to have sources
+// registered with Stream.
+func NewSegmentedStream() *SegmentedStream {
+	return &SegmentedStream{streams: make(map[string]*Stream)}
+}
+
+// Stream returns the Stream for key, creating one with NewStream(path, ...)
+// if it doesn't exist yet.
+func (ss *SegmentedStream) Stream(key, path string, format SegmentFormat, height, bitrate int, codec string) (*Stream, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if s, ok := ss.streams[key]; ok {
+		return s, nil
+	}
+	s, err := NewStream(path, format, height, bitrate, codec)
+	if err != nil {
+		return nil, err
+	}
+	ss.streams[key] = s
+	return s, nil
+}
+
+// ServeManifest writes the HLS playlist or DASH manifest for key once ffmpeg
+// has produced it. key must already have been registered via Stream.
+func (ss *SegmentedStream) ServeManifest(w http.ResponseWriter, r *http.Request, key string) {
+	ss.mu.Lock()
+	s, ok := ss.streams[key]
+	ss.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// Force the encoder to start so the manifest file exists.
+	s.mu.Lock()
+	running := s.cmd != nil
+	s.mu.Unlock()
+	if !running {
+		s.chunk(0)
+	}
+	manifest := filepath.Join(s.dir, "stream.m3u8")
+	if s.format == FormatDASH {
+		manifest = filepath.Join(s.dir, "stream.mpd")
+	}
+	deadline := time.Now().Add(defaultIdleTimeout)
+	for {
+		if _, err := os.Stat(manifest); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			http.Error(w, "manifest not generated in time", http.StatusGatewayTimeout)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	http.ServeFile(w, r, manifest)
+}
+
+// ServeSegment writes segment index of key, blocking until ffmpeg has
+// produced it (restarting the encoder at index first, if it's out of
+// reach).
+func (ss *SegmentedStream) ServeSegment(w http.ResponseWriter, r *http.Request, key string, index int) {
+	ss.mu.Lock()
+	s, ok := ss.streams[key]
+	ss.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	c := s.chunk(index)
+	if err := c.wait(r.Context()); err != nil {
+		status := http.StatusGatewayTimeout
+		if errors.Is(err, errSegmentSuperseded) {
+			status = http.StatusGone
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	http.ServeFile(w, r, c.Path)
+}
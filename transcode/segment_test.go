@@ -0,0 +1,205 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSegmentOpen(t *testing.T) {
+	cases := []struct {
+		name      string
+		line      string
+		wantPath  string
+		wantIndex int
+		wantOK    bool
+	}{
+		{
+			name:      "hls ts segment",
+			line:      `[hls @ 0x55f] Opening '/tmp/dms-segment-1/segment00003.ts' for writing`,
+			wantPath:  "/tmp/dms-segment-1/segment00003.ts",
+			wantIndex: 3,
+			wantOK:    true,
+		},
+		{
+			name:      "hls fmp4 segment",
+			line:      `[hls @ 0x55f] Opening '/tmp/dms-segment-1/segment00012.m4s' for writing`,
+			wantPath:  "/tmp/dms-segment-1/segment00012.m4s",
+			wantIndex: 12,
+			wantOK:    true,
+		},
+		{
+			name:      "dash segment",
+			line:      `[dash @ 0x55f] Opening '/tmp/dms-segment-1/segment00007.m4s' for writing`,
+			wantPath:  "/tmp/dms-segment-1/segment00007.m4s",
+			wantIndex: 7,
+			wantOK:    true,
+		},
+		{
+			name: "dash init segment is not a chunk",
+			line: `[dash @ 0x55f] Opening '/tmp/dms-segment-1/init.m4s' for writing`,
+		},
+		{
+			name: "manifest is not a chunk",
+			line: `[hls @ 0x55f] Opening '/tmp/dms-segment-1/stream.m3u8' for writing`,
+		},
+		{
+			name: "non-opening line",
+			line: `frame=  120 fps= 30 q=-1.0 size=    512kB time=00:00:05.00 bitrate= 838.8kbits/s`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path, index, ok := parseSegmentOpen(c.line)
+			if ok != c.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, c.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if path != c.wantPath || index != c.wantIndex {
+				t.Fatalf("got (%q, %d), want (%q, %d)", path, index, c.wantPath, c.wantIndex)
+			}
+		})
+	}
+}
+
+// TestSegmentArgsStartNumber guards against a restart silently recounting
+// segment numbers from 0 and overwriting files a client may still be
+// reading: the hls muxer must pin its start number to fromIndex. (The dash
+// muxer has no such option; see TestSegmentArgsDASHDoesNotUseStartNumber.)
+func TestSegmentArgsStartNumber(t *testing.T) {
+	cases := []struct {
+		format SegmentFormat
+		flag   string
+	}{
+		{FormatHLSFMP4, "-hls_start_number"},
+		{FormatHLSTS, "-hls_start_number"},
+	}
+	for _, c := range cases {
+		s := &Stream{format: c.format, dir: t.TempDir(), segmentDuration: defaultSegmentDuration}
+		args, err := s.segmentArgs(42)
+		if err != nil {
+			t.Fatalf("format %v: segmentArgs: %v", c.format, err)
+		}
+		if !argPairPresent(args, c.flag, "42") {
+			t.Fatalf("format %v: expected %s 42 in %v", c.format, c.flag, args)
+		}
+	}
+}
+
+// TestSegmentArgsDASHDoesNotUseStartNumber guards against reintroducing
+// -seg_start_number, which ffmpeg's dash muxer doesn't support (unlike hls's
+// -hls_start_number): passing it fails the whole ffmpeg launch. Instead each
+// restart writes into its own subdirectory (see dashSegmentDir), and
+// segmentAbsoluteIndex recovers the true chunk index.
+func TestSegmentArgsDASHDoesNotUseStartNumber(t *testing.T) {
+	s := &Stream{format: FormatDASH, dir: t.TempDir(), segmentDuration: defaultSegmentDuration}
+	args, err := s.segmentArgs(42)
+	if err != nil {
+		t.Fatalf("segmentArgs: %v", err)
+	}
+	for _, a := range args {
+		if strings.Contains(a, "seg_start_number") {
+			t.Fatalf("args = %v, want no seg_start_number (unsupported by the dash muxer)", args)
+		}
+	}
+	if !argPairPresent(args, "-init_seg_name", dashSegmentDir(42)+"/init.m4s") {
+		t.Fatalf("args = %v, want the init segment under %s", args, dashSegmentDir(42))
+	}
+}
+
+// TestSegmentArgsDASHCleansUpPreviousRestartDir guards against leaking a
+// directory per restart: once a restart's manifest is overwritten to point
+// only at its own segDir, the previous restart's directory is unreachable
+// and must be removed, not left behind for the life of the Stream.
+func TestSegmentArgsDASHCleansUpPreviousRestartDir(t *testing.T) {
+	dir := t.TempDir()
+	s := &Stream{format: FormatDASH, dir: dir, segmentDuration: defaultSegmentDuration}
+
+	if _, err := s.segmentArgs(0); err != nil {
+		t.Fatalf("segmentArgs(0): %v", err)
+	}
+	firstDir := filepath.Join(dir, dashSegmentDir(0))
+	if _, err := os.Stat(firstDir); err != nil {
+		t.Fatalf("first restart dir missing: %v", err)
+	}
+
+	if _, err := s.segmentArgs(10); err != nil {
+		t.Fatalf("segmentArgs(10): %v", err)
+	}
+	if _, err := os.Stat(firstDir); !os.IsNotExist(err) {
+		t.Fatalf("first restart dir = %v, want removed once superseded", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, dashSegmentDir(10))); err != nil {
+		t.Fatalf("second restart dir missing: %v", err)
+	}
+}
+
+func TestSegmentAbsoluteIndex(t *testing.T) {
+	cases := []struct {
+		name       string
+		format     SegmentFormat
+		fromIndex  int
+		localIndex int
+		want       int
+	}{
+		{"hls numbering is already absolute", FormatHLSTS, 42, 42, 42},
+		{"dash numbering restarts from 1 and needs fromIndex added back", FormatDASH, 42, 1, 42},
+		{"dash numbering of a later segment in the same restart", FormatDASH, 42, 3, 44},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := segmentAbsoluteIndex(c.format, c.fromIndex, c.localIndex); got != c.want {
+				t.Fatalf("segmentAbsoluteIndex() = %d, want %d", got, c.want)
+			}
+		})
+	}
+}
+
+// TestAbandonBeforeLockedFailsOrphanedChunks guards against a restart
+// silently stranding a chunk that its new encoder run will never produce:
+// wait must return promptly with errSegmentSuperseded rather than blocking
+// until the caller's own context expires.
+func TestAbandonBeforeLockedFailsOrphanedChunks(t *testing.T) {
+	s := &Stream{chunks: make(map[int]*Chunk)}
+	orphan := newChunk(5)
+	s.chunks[5] = orphan
+	survivor := newChunk(10)
+	s.chunks[10] = survivor
+
+	s.abandonBeforeLocked(10)
+
+	if err := orphan.wait(context.Background()); !errors.Is(err, errSegmentSuperseded) {
+		t.Fatalf("orphan.wait() = %v, want errSegmentSuperseded", err)
+	}
+	select {
+	case <-survivor.ready:
+		t.Fatal("survivor chunk should not be abandoned; its index is not before fromIndex")
+	default:
+	}
+}
+
+// TestChunkFulfilAfterAbandonIsANoop guards against a restart's encoder run
+// eventually reaching an index it had already abandoned in an earlier
+// restart and panicking on a double close of its ready channel.
+func TestChunkFulfilAfterAbandonIsANoop(t *testing.T) {
+	c := newChunk(5)
+	c.abandon(errSegmentSuperseded)
+	c.fulfil("/tmp/should-be-ignored.ts")
+	if err := c.wait(context.Background()); !errors.Is(err, errSegmentSuperseded) {
+		t.Fatalf("wait() = %v, want errSegmentSuperseded preserved", err)
+	}
+}
+
+func argPairPresent(args []string, flag, value string) bool {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == flag && args[i+1] == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package transcode
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/Wkh3/dms/misc"
+)
+
+// SubtitleMode selects how a Transcode* call should handle a subtitle
+// track. The previous hard-coded "-scodec copy" fails for most
+// container-to-container transcodes (MPEG-TS can't carry SRT text, MP4
+// can't carry ASS, etc.), so callers must now say what they want instead.
+type SubtitleMode int
+
+const (
+	// SubtitleNone drops subtitles entirely.
+	SubtitleNone SubtitleMode = iota
+	// SubtitlePassthrough re-muxes the subtitle track into a codec the
+	// output container can carry (mov_text for MP4, WebVTT for HLS) as
+	// its own track, without rendering it into the video frames.
+	SubtitlePassthrough
+	// SubtitleSoftMux adds an external sidecar subtitle file as its own
+	// muxed track, rather than converting an embedded one.
+	SubtitleSoftMux
+	// SubtitleBurnIn renders the subtitle into the video frames via the
+	// subtitles filter, so it cannot be combined with a video stream copy.
+	SubtitleBurnIn
+)
+
+// subtitleSidecarExts are the sidecar subtitle formats looked for next to a
+// video file.
+var subtitleSidecarExts = []string{".srt", ".ass", ".vtt"}
+
+// SidecarSubtitle returns the path of a sidecar subtitle file for the
+// video at path (same name, one of subtitleSidecarExts), if one exists.
+func SidecarSubtitle(path string) (string, bool) {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	for _, ext := range subtitleSidecarExts {
+		candidate := base + ext
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// SubtitleStreams returns the embedded subtitle streams in info.
+func (info *MediaInfo) SubtitleStreams() []StreamInfo {
+	var out []StreamInfo
+	for _, s := range info.Streams {
+		if s.CodecType == "subtitle" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// TranscodeOptions configures subtitle handling for a Transcode* call. A
+// zero value means no subtitles.
+type TranscodeOptions struct {
+	Subtitle SubtitleMode
+	// StreamIndex is the embedded subtitle stream to use for
+	// SubtitlePassthrough or SubtitleBurnIn. Ignored for SubtitleSoftMux.
+	StreamIndex int
+	// SidecarPath is the external subtitle file to mux or burn in for
+	// SubtitleSoftMux, or for SubtitleBurnIn, where a non-empty SidecarPath
+	// takes precedence over StreamIndex.
+	SidecarPath string
+}
+
+// escapeSubtitlesFilterPath escapes path for use inside the ffmpeg
+// "subtitles=" filter argument, where backslash, single-quote and colon
+// all need escaping on top of the outer single-quoting we wrap it in.
+func escapeSubtitlesFilterPath(path string) string {
+	r := strings.NewReplacer(
+		`\`, `\\`,
+		`'`, `\'`,
+		`:`, `\:`,
+	)
+	return r.Replace(path)
+}
+
+// subtitleArgs returns the ffmpeg arguments implementing opts for a
+// transcode to an MP4 (hls bool false) or HLS/WebVTT-capable (hls bool
+// true) output:
+//
+//   - preInputArgs must be inserted as its own -i, right after the source's
+//     -i so that it is input 1 (SubtitleSoftMux only, for the sidecar file).
+//   - mapArgs must be appended after all -i options but before the codec
+//     options; once any stream is explicitly mapped, ffmpeg no longer
+//     selects the primary video/audio streams automatically, so mapArgs
+//     for SubtitlePassthrough and SubtitleSoftMux include those too.
+//   - burnInFilter, if non-empty, must be merged into the video encode's
+//     -vf value with appendVideoFilter (SubtitleBurnIn only).
+func subtitleArgs(path string, opts TranscodeOptions, hls bool) (preInputArgs, mapArgs []string, burnInFilter string) {
+	subCodec := "mov_text"
+	if hls {
+		subCodec = "webvtt"
+	}
+	switch opts.Subtitle {
+	case SubtitleNone:
+		return nil, nil, ""
+	case SubtitlePassthrough:
+		return nil, []string{
+			"-map", "0:v:0", "-map", "0:a:0",
+			"-map", "0:" + strconv.Itoa(opts.StreamIndex),
+			"-c:s", subCodec,
+		}, ""
+	case SubtitleSoftMux:
+		return []string{"-i", opts.SidecarPath}, []string{
+			"-map", "0:v:0", "-map", "0:a:0",
+			"-map", "1:0",
+			"-c:s", subCodec,
+		}, ""
+	case SubtitleBurnIn:
+		if opts.SidecarPath != "" {
+			return nil, nil, fmt.Sprintf("subtitles='%s'", escapeSubtitlesFilterPath(opts.SidecarPath))
+		}
+		return nil, nil, fmt.Sprintf("subtitles='%s':stream_index=%d", escapeSubtitlesFilterPath(path), opts.StreamIndex)
+	}
+	return nil, nil, ""
+}
+
+// TranscodeWithOptions streams path as h264 video and mp3 audio in MP4,
+// the same as WebTranscode, with subtitle handling per opts layered on
+// top: mov_text/WebVTT passthrough or soft-mux, or a hard burn-in via the
+// subtitles video filter.
+func TranscodeWithOptions(path string, start, length time.Duration, opts TranscodeOptions, stderr io.Writer) (j *Job, err error) {
+	start = snapToKeyframe(path, start)
+	accel := chosenHWAccel()
+	pre, codec, fallback := videoEncodeArgs(accel, "ultrafast")
+	if accel == HWAccelNone {
+		codec = append(codec, "-crf", "25")
+	}
+
+	preInput, mapArgs, burnInFilter := subtitleArgs(path, opts, false)
+	if burnInFilter != "" {
+		codec = appendVideoFilter(codec, burnInFilter)
+		if fallback != nil {
+			fallback = appendVideoFilter(fallback, burnInFilter)
+		}
+	}
+
+	buildArgs := func(videoArgs []string) []string {
+		args := []string{"ffmpeg"}
+		args = append(args, pre...)
+		args = append(args, "-ss", FormatDurationSexagesimal(start), "-i", path)
+		args = append(args, preInput...)
+		args = append(args, "-pix_fmt", "yuv420p")
+		args = append(args, videoArgs...)
+		args = append(args, "-c:a", "mp3", "-ab", "128k", "-ar", "44100")
+		args = append(args, mapArgs...)
+		args = append(args, "-movflags", "+faststart+frag_keyframe+empty_moov")
+		if length > 0 {
+			args = append(args, "-t", FormatDurationSexagesimal(length))
+		}
+		return append(args, "-f", "mp4", "pipe:")
+	}
+	return transcodePipeWithFallback(path, buildArgs, codec, fallback, stderr)
+}
+
+// ServeSubtitle extracts the subtitle stream at streamIndex from path and
+// writes it in format (e.g. "webvtt") to the returned reader, for the HLS
+// pipeline to serve as its own resource.
+func ServeSubtitle(path string, streamIndex int, format string) (j *Job, err error) {
+	args := []string{
+		"ffmpeg",
+		"-i", path,
+		"-map", "0:" + strconv.Itoa(streamIndex),
+		"-f", format,
+		"pipe:",
+	}
+	return transcodePipe(path, args, os.Stderr)
+}
@@ -0,0 +1,82 @@
+package transcode
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSubtitleArgsNone(t *testing.T) {
+	pre, mapArgs, filter := subtitleArgs("movie.mkv", TranscodeOptions{Subtitle: SubtitleNone}, false)
+	if pre != nil || mapArgs != nil || filter != "" {
+		t.Fatalf("got (%v, %v, %q), want all empty", pre, mapArgs, filter)
+	}
+}
+
+func TestSubtitleArgsPassthrough(t *testing.T) {
+	opts := TranscodeOptions{Subtitle: SubtitlePassthrough, StreamIndex: 2}
+
+	pre, mapArgs, filter := subtitleArgs("movie.mkv", opts, false)
+	if pre != nil {
+		t.Fatalf("preInputArgs = %v, want none", pre)
+	}
+	if filter != "" {
+		t.Fatalf("burnInFilter = %q, want none", filter)
+	}
+	if !argPairPresent(mapArgs, "-map", "0:v:0") || !argPairPresent(mapArgs, "-map", "0:a:0") {
+		t.Fatalf("mapArgs = %v, want primary video and audio streams re-mapped", mapArgs)
+	}
+	if !argPairPresent(mapArgs, "-map", "0:2") {
+		t.Fatalf("mapArgs = %v, want the requested subtitle stream mapped", mapArgs)
+	}
+	if !argPairPresent(mapArgs, "-c:s", "mov_text") {
+		t.Fatalf("mapArgs = %v, want mov_text for a non-HLS output", mapArgs)
+	}
+
+	_, mapArgs, _ = subtitleArgs("movie.mkv", opts, true)
+	if !argPairPresent(mapArgs, "-c:s", "webvtt") {
+		t.Fatalf("mapArgs = %v, want webvtt for an HLS output", mapArgs)
+	}
+}
+
+func TestSubtitleArgsSoftMux(t *testing.T) {
+	opts := TranscodeOptions{Subtitle: SubtitleSoftMux, SidecarPath: "movie.srt"}
+	pre, mapArgs, filter := subtitleArgs("movie.mkv", opts, false)
+
+	if !argPairPresent(pre, "-i", "movie.srt") {
+		t.Fatalf("preInputArgs = %v, want the sidecar as its own -i", pre)
+	}
+	if !argPairPresent(mapArgs, "-map", "0:v:0") || !argPairPresent(mapArgs, "-map", "0:a:0") {
+		t.Fatalf("mapArgs = %v, want primary video and audio streams re-mapped", mapArgs)
+	}
+	if !argPairPresent(mapArgs, "-map", "1:0") {
+		t.Fatalf("mapArgs = %v, want the sidecar's input mapped", mapArgs)
+	}
+	if filter != "" {
+		t.Fatalf("burnInFilter = %q, want none", filter)
+	}
+}
+
+func TestSubtitleArgsBurnIn(t *testing.T) {
+	opts := TranscodeOptions{Subtitle: SubtitleBurnIn, StreamIndex: 3}
+	pre, mapArgs, filter := subtitleArgs("movie.mkv", opts, false)
+	if pre != nil || mapArgs != nil {
+		t.Fatalf("got pre=%v mapArgs=%v, want no input/map args for burn-in", pre, mapArgs)
+	}
+	if !strings.Contains(filter, "subtitles=") || !strings.Contains(filter, "stream_index=3") {
+		t.Fatalf("burnInFilter = %q, want a subtitles filter on stream 3", filter)
+	}
+
+	opts = TranscodeOptions{Subtitle: SubtitleBurnIn, SidecarPath: "movie.ass"}
+	_, _, filter = subtitleArgs("movie.mkv", opts, false)
+	if !strings.Contains(filter, "movie.ass") {
+		t.Fatalf("burnInFilter = %q, want the sidecar path", filter)
+	}
+}
+
+func TestEscapeSubtitlesFilterPath(t *testing.T) {
+	got := escapeSubtitlesFilterPath(`C:\subs\it's "mine".srt`)
+	want := `C\:\\subs\\it\'s "mine".srt`
+	if got != want {
+		t.Fatalf("escapeSubtitlesFilterPath() = %q, want %q", got, want)
+	}
+}
@@ -5,54 +5,52 @@ package transcode
 import (
 	"fmt"
 	"io"
-	"os/exec"
 	"runtime"
 	"strconv"
 	"time"
 
 	"github.com/anacrolix/log"
 
+	"github.com/Wkh3/dms/keyframes"
 	. "github.com/Wkh3/dms/misc"
-	"github.com/anacrolix/ffprobe"
 )
 
-// Invokes an external command and returns a reader from its stdout. The
-// command is waited on asynchronously.
-func transcodePipe(args []string, stderr io.Writer) (r io.ReadCloser, err error) {
-	log.Println("transcode command:", args)
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stderr = stderr
-	r, err = cmd.StdoutPipe()
+// snapToKeyframe snaps start to the nearest keyframe at or before it, so
+// the transcode's input seek lands on an IDR frame and produces no
+// leading black or frozen output. Failure to determine keyframes (e.g. an
+// unsupported container) is not fatal; start is used unmodified.
+func snapToKeyframe(path string, start time.Duration) time.Duration {
+	pts, err := keyframes.Keyframes(path)
 	if err != nil {
-		return
+		log.Printf("keyframes for %s: %s", path, err)
+		return start
 	}
-	err = cmd.Start()
-	if err != nil {
-		return
-	}
-	go func() {
-		err := cmd.Wait()
-		if err != nil {
-			log.Printf("command %s failed: %s", args, err)
-		}
-	}()
-	return
+	return keyframes.NearestAtOrBefore(pts, start)
+}
+
+// transcodePipe starts args (args[0] is the executable) as a tracked Job
+// for source and returns it. It replaces the former bare
+// exec.Cmd.StdoutPipe plumbing: the process is now registered with
+// DefaultTracker, subject to its per-source concurrency limit, and killed
+// on Close rather than left to run if the caller abandons the reader.
+func transcodePipe(source string, args []string, stderr io.Writer) (*Job, error) {
+	return newJob(source, args, stderr)
 }
 
 // Return a series of ffmpeg arguments that pick specific codecs for specific
 // streams. This requires use of the -map flag.
-func streamArgs(s map[string]interface{}) (ret []string) {
+func streamArgs(s StreamInfo) (ret []string) {
 	defer func() {
 		if len(ret) != 0 {
 			ret = append(ret, []string{
-				"-map", "0:" + strconv.Itoa(int(s["index"].(float64))),
+				"-map", "0:" + strconv.Itoa(s.Index),
 			}...)
 		}
 	}()
-	switch s["codec_type"] {
+	switch s.CodecType {
 	case "video":
 		/*
-			if s["codec_name"] == "h264" {
+			if s.CodecName == "h264" {
 				if i, _ := strconv.ParseInt(s["is_avc"], 0, 0); i != 0 {
 					return []string{"-vcodec", "copy", "-sameq", "-vbsf", "h264_mp4toannexb"}
 				}
@@ -60,7 +58,7 @@ func streamArgs(s map[string]interface{}) (ret []string) {
 		*/
 		return []string{"-target", "pal-dvd"}
 	case "audio":
-		if s["codec_name"] == "dca" {
+		if s.CodecName == "dca" {
 			return []string{"-acodec", "ac3", "-ab", "224k", "-ac", "2"}
 		} else {
 			return []string{"-acodec", "copy"}
@@ -72,7 +70,8 @@ func streamArgs(s map[string]interface{}) (ret []string) {
 }
 
 // Streams the desired file in the MPEG_PS_PAL DLNA profile.
-func Transcode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
+func Transcode(path string, start, length time.Duration, stderr io.Writer) (j *Job, err error) {
+	start = snapToKeyframe(path, start)
 	args := []string{
 		"ffmpeg",
 		"-threads", strconv.FormatInt(int64(runtime.NumCPU()), 10),
@@ -87,7 +86,7 @@ func Transcode(path string, start, length time.Duration, stderr io.Writer) (r io
 	args = append(args, []string{
 		"-i", path,
 	}...)
-	info, err := ffprobe.Run(path)
+	info, err := Probe(path)
 	if err != nil {
 		return
 	}
@@ -95,11 +94,14 @@ func Transcode(path string, start, length time.Duration, stderr io.Writer) (r io
 		args = append(args, streamArgs(s)...)
 	}
 	args = append(args, []string{"-f", "mpegts", "pipe:"}...)
-	return transcodePipe(args, stderr)
+	return transcodePipe(path, args, stderr)
 }
 
-// Returns a stream of Chromecast supported VP8.
-func VP8Transcode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
+// Returns a stream of Chromecast supported VP8. Hardware VP8 encoding
+// support is too inconsistent across ffmpeg builds to be worth the
+// complexity of the fallback chain used for the H.264 paths below, so this
+// always encodes in software.
+func VP8Transcode(path string, start, length time.Duration, stderr io.Writer) (j *Job, err error) {
 	args := []string{
 		"avconv",
 		"-threads", strconv.FormatInt(int64(runtime.NumCPU()), 10),
@@ -118,52 +120,59 @@ func VP8Transcode(path string, start, length time.Duration, stderr io.Writer) (r
 		"-f", "webm",
 		"pipe:",
 	}...)
-	return transcodePipe(args, stderr)
+	return transcodePipe(path, args, stderr)
 }
 
-// Returns a stream of Chromecast supported matroska.
-func ChromecastTranscode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
-	args := []string{
-		"ffmpeg",
-		"-ss", FormatDurationSexagesimal(start),
-		"-i", path,
-		"-c:v", "libx264", "-preset", "ultrafast", "-profile:v", "high", "-level", "5.0",
-		"-movflags", "+faststart+frag_keyframe+empty_moov",
-	}
-	if length > 0 {
-		args = append(args, []string{
-			"-t", FormatDurationSexagesimal(length),
-		}...)
+// Returns a stream of Chromecast supported MP4. Prefers a hardware
+// encoder when one is available (see HWAccel), transparently falling back
+// to software if it fails to initialise.
+func ChromecastTranscode(path string, start, length time.Duration, stderr io.Writer) (j *Job, err error) {
+	start = snapToKeyframe(path, start)
+	accel := chosenHWAccel()
+	pre, codec, fallback := videoEncodeArgs(accel, "ultrafast")
+	codec = append(codec, "-profile:v", "high", "-level", "5.0")
+	if fallback != nil {
+		fallback = append(fallback, "-profile:v", "high", "-level", "5.0")
+	}
+
+	buildArgs := func(videoArgs []string) []string {
+		args := []string{"ffmpeg"}
+		args = append(args, pre...)
+		args = append(args, "-ss", FormatDurationSexagesimal(start), "-i", path)
+		args = append(args, videoArgs...)
+		args = append(args, "-movflags", "+faststart+frag_keyframe+empty_moov")
+		if length > 0 {
+			args = append(args, "-t", FormatDurationSexagesimal(length))
+		}
+		return append(args, "-f", "mp4", "pipe:")
 	}
-	args = append(args, []string{
-		"-f", "mp4",
-		"pipe:",
-	}...)
-	return transcodePipe(args, stderr)
+	return transcodePipeWithFallback(path, buildArgs, codec, fallback, stderr)
 }
 
-// Returns a stream of h264 video and mp3 audio
-func WebTranscode(path string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
-	args := []string{
-		"ffmpeg",
-		"-ss", FormatDurationSexagesimal(start),
-		"-i", path,
-		"-pix_fmt", "yuv420p",
-		"-c:v", "libx264", "-crf", "25",
-		"-c:a", "mp3", "-ab", "128k", "-ar", "44100",
-		"-preset", "ultrafast",
-		"-movflags", "+faststart+frag_keyframe+empty_moov",
-	}
-	if length > 0 {
-		args = append(args, []string{
-			"-t", FormatDurationSexagesimal(length),
-		}...)
+// Returns a stream of h264 video and mp3 audio. Prefers a hardware encoder
+// when one is available (see HWAccel), transparently falling back to
+// software if it fails to initialise.
+func WebTranscode(path string, start, length time.Duration, stderr io.Writer) (j *Job, err error) {
+	start = snapToKeyframe(path, start)
+	accel := chosenHWAccel()
+	pre, codec, fallback := videoEncodeArgs(accel, "ultrafast")
+	if accel == HWAccelNone {
+		codec = append(codec, "-crf", "25")
+	}
+
+	buildArgs := func(videoArgs []string) []string {
+		args := []string{"ffmpeg"}
+		args = append(args, pre...)
+		args = append(args, "-ss", FormatDurationSexagesimal(start), "-i", path, "-pix_fmt", "yuv420p")
+		args = append(args, videoArgs...)
+		args = append(args, "-c:a", "mp3", "-ab", "128k", "-ar", "44100")
+		args = append(args, "-movflags", "+faststart+frag_keyframe+empty_moov")
+		if length > 0 {
+			args = append(args, "-t", FormatDurationSexagesimal(length))
+		}
+		return append(args, "-f", "mp4", "pipe:")
 	}
-	args = append(args, []string{
-		"-f", "mp4",
-		"pipe:",
-	}...)
-	return transcodePipe(args, stderr)
+	return transcodePipeWithFallback(path, buildArgs, codec, fallback, stderr)
 }
 
 // credit laurent @ https://stackoverflow.com/questions/34118732/parse-a-command-line-string-into-flags-and-arguments-in-golang
@@ -233,11 +242,11 @@ func parseCommandLine(command string) ([]string, error) {
 }
 
 // Exec runs the cmd to generate the video to stream. It does not support seeking. Used by the dynamic stream feature.
-func Exec(cmds string, start, length time.Duration, stderr io.Writer) (r io.ReadCloser, err error) {
+func Exec(cmds string, start, length time.Duration, stderr io.Writer) (j *Job, err error) {
 	cmda, aerr := parseCommandLine(cmds)
 	if aerr != nil {
 		err = aerr
 		return
 	}
-	return transcodePipe(cmda, stderr)
+	return transcodePipe(cmds, cmda, stderr)
 }